@@ -3,43 +3,108 @@ package app
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 )
 
 const (
 	fakeToken  = "fake_session_token"
 	fakeAPIKey = "fake_api_key"
+
+	healthPath = "/healthz"
+	hstsValue  = "max-age=63072000; includeSubDomains"
 )
 
 type Server struct {
-	mux  *http.ServeMux
-	once sync.Once
+	// RequireHTTPS redirects plain HTTP requests to HTTPS and sets the
+	// Strict-Transport-Security header. See HTTPSRedirectMw.
+	RequireHTTPS bool
+	// TrustProxy trusts X-Forwarded-Proto to report the scheme the client
+	// used. Only enable it behind a TLS-terminating proxy that sets it.
+	TrustProxy bool
+	// Dev issues cookies without the Secure flag so they still work over
+	// plain HTTP during local development. Never set it in production.
+	Dev bool
+
+	mux     *http.ServeMux
+	handler http.Handler
+	once    sync.Once
 }
 
 func (a *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	a.once.Do(func() {
 		a.mux = http.NewServeMux()
 		a.mux.HandleFunc("/", a.home)
+		a.mux.HandleFunc(healthPath, a.health)
 		a.mux.HandleFunc("/login", a.login)
 		a.mux.HandleFunc("/admin", cookieAuthMw(a.admin))
 		a.mux.HandleFunc("/header-admin", headerAuthMw(a.admin))
+		a.handler = a.mux
+		if a.RequireHTTPS {
+			a.handler = HTTPSRedirectMw(a.mux, a.TrustProxy)
+		}
 	})
-	a.mux.ServeHTTP(w, r)
+	a.handler.ServeHTTP(w, r)
 }
 
 func (a *Server) home(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "<h1>Welcome!</h1>")
 }
 
-func (a *Server) login(w http.ResponseWriter, r *http.Request) {
-	cookie := http.Cookie{
-		Name:  "session",
-		Value: fakeToken,
+func (a *Server) health(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "ok")
+}
+
+// cookie builds every cookie the server issues so none of them miss the
+// security flags: Secure (unless in Dev mode), HttpOnly and SameSite=Lax.
+func (a *Server) cookie(name, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Secure:   !a.Dev,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 	}
-	http.SetCookie(w, &cookie)
+}
+
+func (a *Server) login(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, a.cookie("session", fakeToken))
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
+// HTTPSRedirectMw redirects requests that did not arrive over HTTPS to the
+// same URL on https and sets Strict-Transport-Security on the ones that did.
+// When trustProxy is true the X-Forwarded-Proto header decides the scheme;
+// otherwise only a direct TLS connection counts. Health checks are served
+// as-is so a load balancer probing over plain HTTP still sees them.
+func HTTPSRedirectMw(next http.Handler, trustProxy bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == healthPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !isHTTPS(r, trustProxy) {
+			target := "https://" + r.Host + r.URL.RequestURI()
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Strict-Transport-Security", hstsValue)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isHTTPS(r *http.Request, trustProxy bool) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if !trustProxy {
+		return false
+	}
+	// Proxies may append to the header; the first entry is the client's.
+	proto := strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
 func cookieAuthMw(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		c, err := r.Cookie("session")
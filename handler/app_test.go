@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/joncalhoun/twg/app"
+	handler "github.com/joncalhoun/twg/handler"
 	"golang.org/x/net/publicsuffix"
 )
 
@@ -51,7 +52,8 @@ func (hc headerClient) Get(url string) (*http.Response, error) {
 }
 
 func TestApp(t *testing.T) {
-	server := httptest.NewServer(&app.Server{})
+	// Dev mode lets the session cookie travel over the plain HTTP test server.
+	server := httptest.NewServer(&app.Server{Dev: true})
 	defer server.Close()
 	t.Run("cookie based auth", func(t *testing.T) {
 		client := signedInClient(t, server.URL)
@@ -91,3 +93,115 @@ func TestApp(t *testing.T) {
 		}
 	})
 }
+
+func TestHTTPSRedirectMw(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	tests := map[string]struct {
+		target     string
+		forwarded  string
+		trustProxy bool
+		wantCode   int
+		wantLoc    string
+		wantHSTS   bool
+	}{
+		"forwarded https": {
+			target: "http://example.com/admin", forwarded: "https", trustProxy: true,
+			wantCode: http.StatusOK, wantHSTS: true,
+		},
+		"forwarded https first in list": {
+			target: "http://example.com/admin", forwarded: "https, http", trustProxy: true,
+			wantCode: http.StatusOK, wantHSTS: true,
+		},
+		"forwarded http": {
+			target: "http://example.com/admin?x=1", forwarded: "http", trustProxy: true,
+			wantCode: http.StatusMovedPermanently, wantLoc: "https://example.com/admin?x=1",
+		},
+		"forwarded unset": {
+			target: "http://example.com/admin", trustProxy: true,
+			wantCode: http.StatusMovedPermanently, wantLoc: "https://example.com/admin",
+		},
+		"forwarded https from untrusted proxy": {
+			target: "http://example.com/admin", forwarded: "https",
+			wantCode: http.StatusMovedPermanently, wantLoc: "https://example.com/admin",
+		},
+		"direct tls": {
+			target:   "https://example.com/admin",
+			wantCode: http.StatusOK, wantHSTS: true,
+		},
+		"health check over http": {
+			target: "http://example.com/healthz", trustProxy: true,
+			wantCode: http.StatusOK,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.forwarded != "" {
+				r.Header.Set("X-Forwarded-Proto", tc.forwarded)
+			}
+			handler.HTTPSRedirectMw(ok, tc.trustProxy).ServeHTTP(w, r)
+
+			res := w.Result()
+			if res.StatusCode != tc.wantCode {
+				t.Errorf("code = %d; want %d", res.StatusCode, tc.wantCode)
+			}
+			if got := res.Header.Get("Location"); got != tc.wantLoc {
+				t.Errorf("Location = %q; want %q", got, tc.wantLoc)
+			}
+			hsts := res.Header.Get("Strict-Transport-Security")
+			if (hsts != "") != tc.wantHSTS {
+				t.Errorf("Strict-Transport-Security = %q; want set = %t", hsts, tc.wantHSTS)
+			}
+		})
+	}
+}
+
+func TestServer_RequireHTTPS(t *testing.T) {
+	server := &handler.Server{RequireHTTPS: true, TrustProxy: true}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/admin", nil))
+	if code := w.Result().StatusCode; code != http.StatusMovedPermanently {
+		t.Errorf("GET /admin code = %d; want %d", code, http.StatusMovedPermanently)
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/healthz", nil))
+	if code := w.Result().StatusCode; code != http.StatusOK {
+		t.Errorf("GET /healthz code = %d; want %d", code, http.StatusOK)
+	}
+}
+
+func TestServer_loginCookie(t *testing.T) {
+	tests := map[string]struct {
+		server     *handler.Server
+		wantSecure bool
+	}{
+		"secure": {&handler.Server{}, true},
+		"dev":    {&handler.Server{Dev: true}, false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tc.server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/login", nil))
+
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("Set-Cookie = %v; want one cookie", w.Result().Header["Set-Cookie"])
+			}
+			c := cookies[0]
+			if c.Secure != tc.wantSecure {
+				t.Errorf("Secure = %t; want %t", c.Secure, tc.wantSecure)
+			}
+			if !c.HttpOnly {
+				t.Errorf("HttpOnly = false; want true")
+			}
+			if c.SameSite != http.SameSiteLaxMode {
+				t.Errorf("SameSite = %v; want %v", c.SameSite, http.SameSiteLaxMode)
+			}
+		})
+	}
+}
@@ -1,34 +1,137 @@
 package stripe
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 const (
 	Version         = "2018-09-24"
 	DefaultCurrency = "usd"
 	DefaultBaseURL  = "https://api.stripe.com/v1"
+
+	// DefaultTimeout bounds each request when no HttpClient is provided, so
+	// a hung connection to Stripe can't stall a caller indefinitely.
+	DefaultTimeout = 30 * time.Second
+
+	// DefaultMaxAttempts is how many times a retryable request is tried
+	// when Client.MaxAttempts isn't set.
+	DefaultMaxAttempts = 3
 )
 
+var retryBaseDelay = 100 * time.Millisecond
+
 type Customer struct {
 	ID            string `json:"id"`
 	DefaultSource string `json:"default_source"`
 	Email         string `json:"email"`
 }
 
+// HasSource reports whether the customer has a default payment source that
+// can be charged. Some tokens create a customer without attaching a card.
+// Cards saved through a SetupIntent are not default sources; charge those
+// by passing the SetupIntent's PaymentMethod as ChargeParams.Source.
+func (cus *Customer) HasSource() bool {
+	return cus.DefaultSource != ""
+}
+
 type Charge struct {
-	ID             string `json:"id"`
-	Amount         int    `json:"amount"`
-	FailureCode    string `json:"failure_code"`
-	FailureMessage string `json:"failure_message"`
-	Paid           bool   `json:"paid"`
-	Status         string `json:"status"`
+	ID                  string            `json:"id"`
+	Amount              int               `json:"amount"`
+	AmountRefunded      int               `json:"amount_refunded"`
+	Captured            bool              `json:"captured"`
+	Currency            string            `json:"currency"`
+	FailureCode         string            `json:"failure_code"`
+	FailureMessage      string            `json:"failure_message"`
+	Metadata            map[string]string `json:"metadata"`
+	Paid                bool              `json:"paid"`
+	Refunded            bool              `json:"refunded"`
+	StatementDescriptor string            `json:"statement_descriptor"`
+	Status              ChargeStatus      `json:"status"`
+}
+
+// ChargeParams holds the optional settings for ChargeWithParams. Zero values
+// fall back to the Client's defaults.
+type ChargeParams struct {
+	// Currency is an ISO code such as "eur". Empty uses DefaultCurrency.
+	// Charging in a currency this package doesn't support returns an error
+	// without contacting Stripe.
+	Currency            string
+	StatementDescriptor string
+
+	// Capture set to false only authorizes the charge; the money is taken
+	// later with Capture, or the authorization released with Void. Nil
+	// captures immediately.
+	Capture *bool
+
+	// Source is the card, source or payment method to charge instead of
+	// the customer's default source, such as a SetupIntent's PaymentMethod.
+	// It must belong to the customer.
+	Source string
+
+	// Metadata is stored on the charge and shown in the Stripe dashboard,
+	// e.g. an order ID so support can trace a charge back to its order.
+	Metadata map[string]string
+
+	// IdempotencyKey makes retrying a charge safe: Stripe returns the
+	// original charge for any later request with the same key instead of
+	// charging the customer again. Derive it from something stable, such as
+	// the order ID.
+	IdempotencyKey string
+}
+
+type ChargeStatus string
+
+const (
+	ChargeSucceeded ChargeStatus = "succeeded"
+	ChargePending   ChargeStatus = "pending"
+	ChargeFailed    ChargeStatus = "failed"
+)
+
+// ParseChargeStatus returns the ChargeStatus matching s, or an error if s
+// isn't a status Stripe is known to return.
+func ParseChargeStatus(s string) (ChargeStatus, error) {
+	switch status := ChargeStatus(s); status {
+	case ChargeSucceeded, ChargePending, ChargeFailed:
+		return status, nil
+	}
+	return "", fmt.Errorf("stripe: unknown charge status %q", s)
+}
+
+type Refund struct {
+	ID       string `json:"id"`
+	Amount   int    `json:"amount"`
+	ChargeID string `json:"charge"`
+	Status   string `json:"status"`
+}
+
+// RefundParams are optional settings for a single refund.
+type RefundParams struct {
+	// Amount is how much of the charge to refund, in the currency's
+	// smallest unit. Zero refunds whatever hasn't been refunded yet.
+	Amount int
+}
+
+type SetupIntent struct {
+	ID           string `json:"id"`
+	ClientSecret string `json:"client_secret"`
+	Customer     string `json:"customer"`
+	// PaymentMethod is the saved card (pm_...). It is empty until the
+	// customer completes the SetupIntent with Stripe.js.
+	PaymentMethod string `json:"payment_method"`
+	Status        string `json:"status"`
 }
 
 type Client struct {
@@ -37,12 +140,27 @@ type Client struct {
 	HttpClient interface {
 		Do(*http.Request) (*http.Response, error)
 	}
+
+	// StatementDescriptor is shown on the customer's card statement for
+	// charges that don't set their own. Empty uses the account default.
+	StatementDescriptor string
+
+	// Observe, if set, is called after every API call with the operation
+	// name (e.g. "charge"), its Outcome, and how long it took. Use it to
+	// feed latency histograms or counters.
+	Observe func(op, outcome string, d time.Duration)
+
+	// MaxAttempts limits how many times a request is tried when Stripe
+	// returns a 5xx or the connection fails. Only GETs and charges with an
+	// IdempotencyKey are retried. Zero uses DefaultMaxAttempts; 1 disables
+	// retries.
+	MaxAttempts int
 }
 
 func (c *Client) do(req *http.Request) (*http.Response, error) {
 	httpClient := c.HttpClient
 	if httpClient == nil {
-		httpClient = &http.Client{}
+		httpClient = defaultHTTPClient()
 	}
 	req.Header.Set("Stripe-Version", Version)
 	if req.Method != http.MethodGet {
@@ -52,6 +170,11 @@ func (c *Client) do(req *http.Request) (*http.Response, error) {
 	return httpClient.Do(req)
 }
 
+// defaultHTTPClient is used when the Client has no HttpClient.
+func defaultHTTPClient() *http.Client {
+	return &http.Client{Timeout: DefaultTimeout}
+}
+
 func (c *Client) url(path string) string {
 	if c.BaseURL == "" {
 		c.BaseURL = DefaultBaseURL
@@ -60,63 +183,347 @@ func (c *Client) url(path string) string {
 }
 
 func (c *Client) Customer(token, email string) (*Customer, error) {
-	endpoint := c.url("/customers")
+	return c.CustomerContext(context.Background(), token, email)
+}
+
+func (c *Client) CustomerContext(ctx context.Context, token, email string) (*Customer, error) {
 	v := url.Values{}
 	v.Set("source", token)
 	v.Set("email", email)
-	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(v.Encode()))
+	var cus Customer
+	err := c.post(ctx, "customer", "/customers", v, &cus)
 	if err != nil {
 		return nil, err
 	}
-	res, err := c.do(req)
+	return &cus, nil
+}
+
+func (c *Client) Charge(customerID string, amount int) (*Charge, error) {
+	return c.ChargeContext(context.Background(), customerID, amount, nil)
+}
+
+func (c *Client) ChargeWithParams(customerID string, amount int, params *ChargeParams) (*Charge, error) {
+	return c.ChargeContext(context.Background(), customerID, amount, params)
+}
+
+// ChargeContext is like ChargeWithParams, but the request is aborted if ctx
+// is cancelled before Stripe responds. params may be nil.
+func (c *Client) ChargeContext(ctx context.Context, customerID string, amount int, params *ChargeParams) (*Charge, error) {
+	if params == nil {
+		params = &ChargeParams{}
+	}
+	currency := DefaultCurrency
+	if params.Currency != "" {
+		currency = strings.ToLower(params.Currency)
+	}
+	if _, ok := currencies[currency]; !ok {
+		return nil, fmt.Errorf("stripe: unsupported currency %q", currency)
+	}
+	v := url.Values{}
+	v.Set("customer", customerID)
+	v.Set("amount", strconv.Itoa(amount))
+	v.Set("currency", currency)
+	if params.Source != "" {
+		v.Set("source", params.Source)
+	}
+	if params.Capture != nil {
+		v.Set("capture", strconv.FormatBool(*params.Capture))
+	}
+	for key, value := range params.Metadata {
+		v.Set("metadata["+key+"]", value)
+	}
+	descriptor := params.StatementDescriptor
+	if descriptor == "" {
+		descriptor = c.StatementDescriptor
+	}
+	if descriptor != "" {
+		if err := ValidateStatementDescriptor(descriptor); err != nil {
+			return nil, err
+		}
+		v.Set("statement_descriptor", descriptor)
+	}
+	var chg Charge
+	err := c.call(ctx, "charge", http.MethodPost, "/charges", params.IdempotencyKey, v, &chg)
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	return &chg, nil
+}
+
+func (c *Client) GetCharge(chargeID string) (*Charge, error) {
+	return c.GetChargeContext(context.Background(), chargeID)
+}
+
+func (c *Client) GetChargeContext(ctx context.Context, chargeID string) (*Charge, error) {
+	var chg Charge
+	err := c.get(ctx, "get_charge", "/charges/"+url.PathEscape(chargeID), &chg)
 	if err != nil {
 		return nil, err
 	}
-	if res.StatusCode >= 400 {
-		return nil, parseError(body)
+	return &chg, nil
+}
+
+// Capture takes the money for a charge created with ChargeParams.Capture
+// set to false, returning the updated charge.
+func (c *Client) Capture(chargeID string) (*Charge, error) {
+	return c.CaptureContext(context.Background(), chargeID)
+}
+
+func (c *Client) CaptureContext(ctx context.Context, chargeID string) (*Charge, error) {
+	var chg Charge
+	err := c.post(ctx, "capture", "/charges/"+url.PathEscape(chargeID)+"/capture", url.Values{}, &chg)
+	if err != nil {
+		return nil, err
 	}
-	var cus Customer
-	err = json.Unmarshal(body, &cus)
+	return &chg, nil
+}
+
+// Void releases an authorized but uncaptured charge without taking any
+// money, returning the updated charge. If the charge was already captured
+// Void returns ErrAlreadyCaptured and leaves it untouched; callers that
+// want to return the money must issue a real refund instead.
+//
+// Stripe has no void-only endpoint, so Void checks the charge and then
+// refunds it. A Capture that lands between those two requests turns the
+// void into a full refund, so don't void and capture the same charge
+// concurrently.
+func (c *Client) Void(chargeID string) (*Charge, error) {
+	return c.VoidContext(context.Background(), chargeID)
+}
+
+func (c *Client) VoidContext(ctx context.Context, chargeID string) (chg *Charge, err error) {
+	defer c.observe("void", time.Now(), &err)
+	var current Charge
+	err = c.request(ctx, http.MethodGet, "/charges/"+url.PathEscape(chargeID), "", nil, &current)
 	if err != nil {
 		return nil, err
 	}
-	return &cus, nil
+	if current.Captured {
+		return nil, ErrAlreadyCaptured
+	}
+	var refund struct {
+		Charge Charge `json:"charge"`
+	}
+	err = c.refund(ctx, chargeID, nil, []string{"charge"}, &refund)
+	if err != nil {
+		return nil, err
+	}
+	return &refund.Charge, nil
 }
 
-func (c *Client) Charge(customerID string, amount int) (*Charge, error) {
-	endpoint := c.url("/charges")
+// Refund refunds the full amount of a charge.
+func (c *Client) Refund(chargeID string) (*Refund, error) {
+	return c.RefundContext(context.Background(), chargeID, nil)
+}
+
+func (c *Client) RefundWithParams(chargeID string, params *RefundParams) (*Refund, error) {
+	return c.RefundContext(context.Background(), chargeID, params)
+}
+
+// RefundContext is like RefundWithParams, but the request is aborted if ctx
+// is cancelled before Stripe responds. params may be nil.
+func (c *Client) RefundContext(ctx context.Context, chargeID string, params *RefundParams) (re *Refund, err error) {
+	defer c.observe("refund", time.Now(), &err)
+	var r Refund
+	err = c.refund(ctx, chargeID, params, nil, &r)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// refund creates a refund without reporting it to Observe, so operations
+// built on it such as Void are observed once under their own name. expand
+// names related objects Stripe should return in full instead of as IDs.
+func (c *Client) refund(ctx context.Context, chargeID string, params *RefundParams, expand []string, dst interface{}) error {
+	if params == nil {
+		params = &RefundParams{}
+	}
+	if params.Amount < 0 {
+		return fmt.Errorf("stripe: refund amount %d must not be negative", params.Amount)
+	}
+	v := url.Values{}
+	v.Set("charge", chargeID)
+	if params.Amount > 0 {
+		v.Set("amount", strconv.Itoa(params.Amount))
+	}
+	for _, e := range expand {
+		v.Add("expand[]", e)
+	}
+	return c.request(ctx, http.MethodPost, "/refunds", "", v, dst)
+}
+
+// CreateSetupIntent starts saving a card for customerID without charging
+// it. The returned ClientSecret is used by Stripe.js to collect the card.
+// Once the customer has done so, GetSetupIntent reports the saved
+// PaymentMethod, which can be charged later by passing it as
+// ChargeParams.Source.
+func (c *Client) CreateSetupIntent(customerID string) (*SetupIntent, error) {
+	return c.CreateSetupIntentContext(context.Background(), customerID)
+}
+
+func (c *Client) CreateSetupIntentContext(ctx context.Context, customerID string) (*SetupIntent, error) {
 	v := url.Values{}
 	v.Set("customer", customerID)
-	v.Set("amount", strconv.Itoa(amount))
-	v.Set("currency", DefaultCurrency)
-	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(v.Encode()))
+	v.Set("usage", "off_session")
+	var si SetupIntent
+	err := c.post(ctx, "setup_intent", "/setup_intents", v, &si)
 	if err != nil {
 		return nil, err
 	}
-	res, err := c.do(req)
+	return &si, nil
+}
+
+func (c *Client) GetSetupIntent(setupIntentID string) (*SetupIntent, error) {
+	return c.GetSetupIntentContext(context.Background(), setupIntentID)
+}
+
+func (c *Client) GetSetupIntentContext(ctx context.Context, setupIntentID string) (*SetupIntent, error) {
+	var si SetupIntent
+	err := c.get(ctx, "get_setup_intent", "/setup_intents/"+url.PathEscape(setupIntentID), &si)
 	if err != nil {
 		return nil, err
 	}
+	return &si, nil
+}
+
+func (c *Client) get(ctx context.Context, op, path string, dst interface{}) error {
+	return c.call(ctx, op, http.MethodGet, path, "", nil, dst)
+}
+
+func (c *Client) post(ctx context.Context, op, path string, v url.Values, dst interface{}) error {
+	return c.call(ctx, op, http.MethodPost, path, "", v, dst)
+}
+
+// call makes a single API call reported to Observe as op.
+func (c *Client) call(ctx context.Context, op, method, path, idempotencyKey string, v url.Values, dst interface{}) (err error) {
+	defer c.observe(op, time.Now(), &err)
+	return c.request(ctx, method, path, idempotencyKey, v, dst)
+}
+
+// observe reports an operation that began at start to Observe. It is meant
+// to be deferred with a pointer to the operation's named error result.
+func (c *Client) observe(op string, start time.Time, err *error) {
+	if c.Observe != nil {
+		c.Observe(op, Outcome(*err), time.Since(start))
+	}
+}
+
+func (c *Client) request(ctx context.Context, method, path, idempotencyKey string, v url.Values, dst interface{}) (err error) {
+	// Only retry requests Stripe won't act on twice.
+	attempts := 1
+	if method == http.MethodGet || idempotencyKey != "" {
+		attempts = c.maxAttempts()
+	}
+	var status int
+	var header http.Header
+	var body []byte
+	for attempt := 1; ; attempt++ {
+		status, header, body, err = c.send(ctx, method, path, idempotencyKey, v)
+		if !shouldRetry(status, header, err) || attempt >= attempts || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-time.After(backoff(attempt)):
+		case <-ctx.Done():
+			return fmt.Errorf("stripe: %s %s: %w", method, path, ctx.Err())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if status >= 400 {
+		return parseError(body)
+	}
+	return json.Unmarshal(body, dst)
+}
+
+func (c *Client) send(ctx context.Context, method, path, idempotencyKey string, v url.Values) (int, http.Header, []byte, error) {
+	var reqBody io.Reader
+	if v != nil {
+		reqBody = strings.NewReader(v.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path), reqBody)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
 	defer res.Body.Close()
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
-	}
-	if res.StatusCode >= 400 {
-		return nil, parseError(body)
+		return 0, nil, nil, err
 	}
+	return res.StatusCode, res.Header, body, nil
+}
 
-	var chg Charge
-	err = json.Unmarshal(body, &chg)
+// shouldRetry reports whether a response or error is worth another
+// attempt. Stripe's Stripe-Should-Retry header wins when present; it is
+// false, for example, when Stripe has stored a 500 against an idempotency
+// key and will only replay it. Otherwise 5xx responses and transport
+// failures (connection errors, timeouts, dropped connections) are retried.
+// Errors that repeat every time, such as a malformed BaseURL or an
+// unsupported scheme, are not.
+func shouldRetry(status int, header http.Header, err error) bool {
 	if err != nil {
-		return nil, err
+		var ue *url.Error
+		for errors.As(err, &ue) {
+			err = ue.Err
+		}
+		var ne net.Error
+		return errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
 	}
-	return &chg, nil
+	switch header.Get("Stripe-Should-Retry") {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return status >= 500
+}
+
+func (c *Client) maxAttempts() int {
+	if c.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return c.MaxAttempts
+}
+
+// backoff returns how long to wait before retrying after the given attempt:
+// retryBaseDelay doubled for each prior attempt, with up to half of it
+// randomised so clients retrying together spread out.
+func backoff(attempt int) time.Duration {
+	d := retryBaseDelay << uint(attempt-1)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// ValidateStatementDescriptor checks s against Stripe's rules for statement
+// descriptors: 5-22 ASCII characters, at least one letter, and none of
+// < > \ ' " *.
+func ValidateStatementDescriptor(s string) error {
+	if len(s) < 5 || len(s) > 22 {
+		return fmt.Errorf("stripe: statement descriptor %q must be 5-22 characters", s)
+	}
+	hasLetter := false
+	for _, r := range s {
+		switch {
+		case r > unicode.MaxASCII:
+			return fmt.Errorf("stripe: statement descriptor %q must be ASCII", s)
+		case strings.ContainsRune(`<>\'"*`, r):
+			return fmt.Errorf("stripe: statement descriptor %q contains invalid character %q", s, r)
+		case unicode.IsLetter(r):
+			hasLetter = true
+		}
+	}
+	if !hasLetter {
+		return fmt.Errorf("stripe: statement descriptor %q must contain a letter", s)
+	}
+	return nil
 }
 
 func parseError(data []byte) error {
@@ -1,16 +1,23 @@
 package stripe_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/joncalhoun/twg/stripe"
 )
@@ -84,10 +91,13 @@ func TestClient_Local(t *testing.T) {
 		Key:     "gibberish-key",
 		BaseURL: server.URL,
 	}
-	_, err := c.Customer("random token", "random email")
+	cus, err := c.Customer("random token", "random email")
 	if err != nil {
 		t.Fatalf("err = %v; want nil", err)
 	}
+	if cus.HasSource() {
+		t.Errorf("HasSource() = true; want false for a null default_source")
+	}
 }
 
 func stripeClient(t *testing.T) (*stripe.Client, func()) {
@@ -193,6 +203,17 @@ func TestClient_Customer(t *testing.T) {
 			}
 		}
 	}
+	hasDeclineCode := func(code string) checkFn {
+		return func(t *testing.T, cus *stripe.Customer, err error) {
+			se, ok := err.(stripe.Error)
+			if !ok {
+				t.Fatalf("err isn't a stripe.Error")
+			}
+			if se.DeclineCode != code {
+				t.Errorf("err.DeclineCode = %s; want %s", se.DeclineCode, code)
+			}
+		}
+	}
 	hasIDPrefix := func() checkFn {
 		return func(t *testing.T, cus *stripe.Customer, err error) {
 			if !strings.HasPrefix(cus.ID, "cus_") {
@@ -205,6 +226,9 @@ func TestClient_Customer(t *testing.T) {
 			if !strings.HasPrefix(cus.DefaultSource, "card_") {
 				t.Errorf("DefaultSource = %s; want prefix %q", cus.DefaultSource, "card_")
 			}
+			if !cus.HasSource() {
+				t.Errorf("HasSource() = false; want true")
+			}
 		}
 	}
 	hasEmail := func(email string) checkFn {
@@ -243,7 +267,7 @@ func TestClient_Customer(t *testing.T) {
 		"insufficient funds": {
 			token:  tokenInsufficientFunds,
 			email:  "test@testwithgo.com",
-			checks: check(hasErrType(stripe.ErrTypeCardError)),
+			checks: check(hasErrType(stripe.ErrTypeCardError), hasDeclineCode("insufficient_funds")),
 		},
 	}
 	for name, tc := range tests {
@@ -280,6 +304,13 @@ func TestClient_Charge(t *testing.T) {
 			}
 		}
 	}
+	hasStatus := func(status stripe.ChargeStatus) checkFn {
+		return func(t *testing.T, charge *stripe.Charge, err error) {
+			if charge.Status != status {
+				t.Errorf("Status = %s; want %s", charge.Status, status)
+			}
+		}
+	}
 	hasErrType := func(typee string) checkFn {
 		return func(t *testing.T, charge *stripe.Charge, err error) {
 			se, ok := err.(stripe.Error)
@@ -292,6 +323,18 @@ func TestClient_Charge(t *testing.T) {
 		}
 	}
 
+	hasDeclineCode := func(code string) checkFn {
+		return func(t *testing.T, charge *stripe.Charge, err error) {
+			se, ok := err.(stripe.Error)
+			if !ok {
+				t.Fatalf("err isn't a stripe.Error")
+			}
+			if se.DeclineCode != code {
+				t.Errorf("err.DeclineCode = %s; want %s", se.DeclineCode, code)
+			}
+		}
+	}
+
 	customerViaToken := func(token string) func(*testing.T, *stripe.Client) string {
 		return func(t *testing.T, c *stripe.Client) string {
 			email := "test@testwithgo.com"
@@ -311,17 +354,17 @@ func TestClient_Charge(t *testing.T) {
 		"valid charge with amex": {
 			customerID: customerViaToken(tokenAmex),
 			amount:     1234,
-			checks:     check(hasNoErr(), hasAmount(1234)),
+			checks:     check(hasNoErr(), hasAmount(1234), hasStatus(stripe.ChargeSucceeded)),
 		},
 		"valid charge with visa debit": {
 			customerID: customerViaToken(tokenVisaDebit),
 			amount:     8787,
-			checks:     check(hasNoErr(), hasAmount(8787)),
+			checks:     check(hasNoErr(), hasAmount(8787), hasStatus(stripe.ChargeSucceeded)),
 		},
 		"valid charge with mastercard prepaid": {
 			customerID: customerViaToken(tokenMastercardPrepaid),
 			amount:     98765,
-			checks:     check(hasNoErr(), hasAmount(98765)),
+			checks:     check(hasNoErr(), hasAmount(98765), hasStatus(stripe.ChargeSucceeded)),
 		},
 		"invalid customer id": {
 			customerID: func(*testing.T, *stripe.Client) string {
@@ -333,7 +376,7 @@ func TestClient_Charge(t *testing.T) {
 		"charge failure": {
 			customerID: customerViaToken(tokenChargeCustomerFail),
 			amount:     5555,
-			checks:     check(hasErrType(stripe.ErrTypeCardError)),
+			checks:     check(hasErrType(stripe.ErrTypeCardError), hasDeclineCode("generic_decline")),
 		},
 	}
 	for name, tc := range tests {
@@ -348,3 +391,988 @@ func TestClient_Charge(t *testing.T) {
 		})
 	}
 }
+
+func TestParseChargeStatus(t *testing.T) {
+	for _, want := range []stripe.ChargeStatus{stripe.ChargeSucceeded, stripe.ChargePending, stripe.ChargeFailed} {
+		got, err := stripe.ParseChargeStatus(string(want))
+		if err != nil {
+			t.Errorf("ParseChargeStatus(%q) err = %v; want nil", want, err)
+		}
+		if got != want {
+			t.Errorf("ParseChargeStatus(%q) = %q; want %q", want, got, want)
+		}
+	}
+	_, err := stripe.ParseChargeStatus("succeded")
+	if err == nil {
+		t.Errorf("ParseChargeStatus(%q) err = nil; want non-nil", "succeded")
+	}
+}
+
+func TestClient_SetupIntentLifecycle(t *testing.T) {
+	// The fake Stripe below saves a card for cus_123 through a SetupIntent.
+	// The customer has no default source, so charges must name the saved
+	// payment method.
+	intent := map[string]string{
+		"id":            "seti_123",
+		"object":        "setup_intent",
+		"client_secret": "seti_123_secret_abc",
+		"customer":      "cus_123",
+		"status":        "requires_payment_method",
+	}
+	// confirm stands in for Stripe.js collecting the card in the browser.
+	confirm := func() {
+		intent["status"] = "succeeded"
+		intent["payment_method"] = "pm_123"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/setup_intents", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("Method = %s; want %s", r.Method, http.MethodPost)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("ParseForm() err = %v; want nil", err)
+		}
+		if got := r.PostForm.Get("customer"); got != "cus_123" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(errorJSON)
+			return
+		}
+		json.NewEncoder(w).Encode(intent)
+	})
+	mux.HandleFunc("/setup_intents/seti_123", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(intent)
+	})
+	mux.HandleFunc("/charges", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("ParseForm() err = %v; want nil", err)
+		}
+		if r.PostForm.Get("customer") != "cus_123" || r.PostForm.Get("source") != intent["payment_method"] || intent["payment_method"] == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": {"code": "missing", "message": "Cannot charge a customer that has no active card", "param": "card", "type": "card_error"}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"id": "ch_123", "amount": %s, "status": "succeeded"}`, r.PostForm.Get("amount"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	c := stripe.Client{
+		Key:     "gibberish-key",
+		BaseURL: server.URL,
+	}
+
+	si, err := c.CreateSetupIntent("cus_123")
+	if err != nil {
+		t.Fatalf("CreateSetupIntent() err = %v; want nil", err)
+	}
+	if si.ClientSecret != "seti_123_secret_abc" {
+		t.Errorf("ClientSecret = %s; want %s", si.ClientSecret, "seti_123_secret_abc")
+	}
+	if si.Status != "requires_payment_method" {
+		t.Errorf("Status = %s; want %s", si.Status, "requires_payment_method")
+	}
+	if si.PaymentMethod != "" {
+		t.Errorf("PaymentMethod = %s; want empty before the card is collected", si.PaymentMethod)
+	}
+
+	confirm()
+	si, err = c.GetSetupIntent(si.ID)
+	if err != nil {
+		t.Fatalf("GetSetupIntent() err = %v; want nil", err)
+	}
+	if si.Status != "succeeded" {
+		t.Errorf("Status = %s; want %s", si.Status, "succeeded")
+	}
+	if si.PaymentMethod != "pm_123" {
+		t.Fatalf("PaymentMethod = %s; want %s", si.PaymentMethod, "pm_123")
+	}
+
+	if _, err := c.Charge(si.Customer, 1234); err == nil {
+		t.Errorf("Charge() without the saved payment method err = nil; want a card error")
+	}
+	charge, err := c.ChargeWithParams(si.Customer, 1234, &stripe.ChargeParams{Source: si.PaymentMethod})
+	if err != nil {
+		t.Fatalf("ChargeWithParams() err = %v; want nil", err)
+	}
+	if charge.Amount != 1234 {
+		t.Errorf("Amount = %d; want %d", charge.Amount, 1234)
+	}
+
+	_, err = c.CreateSetupIntent("cus_missing")
+	se, ok := err.(stripe.Error)
+	if !ok {
+		t.Fatalf("err isn't a stripe.Error")
+	}
+	if se.Type != stripe.ErrTypeInvalidRequest {
+		t.Errorf("err.Type = %s; want %s", se.Type, stripe.ErrTypeInvalidRequest)
+	}
+}
+
+func TestClient_ChargeWithParams_statementDescriptor(t *testing.T) {
+	var requests int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/charges", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("ParseForm() err = %v; want nil", err)
+		}
+		fmt.Fprintf(w, `{"id": "ch_123", "amount": 1234, "status": "succeeded", "statement_descriptor": %q}`, r.PostForm.Get("statement_descriptor"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := map[string]struct {
+		clientDefault string
+		params        *stripe.ChargeParams
+		want          string
+		wantErr       bool
+	}{
+		"no descriptor": {
+			want: "",
+		},
+		"client default": {
+			clientDefault: "TWG SWAG",
+			want:          "TWG SWAG",
+		},
+		"param overrides default": {
+			clientDefault: "TWG SWAG",
+			params:        &stripe.ChargeParams{StatementDescriptor: "TWG GOPHER SHIRT"},
+			want:          "TWG GOPHER SHIRT",
+		},
+		"too long": {
+			params:  &stripe.ChargeParams{StatementDescriptor: "TEST WITH GO SWAG STORE ORDER"},
+			wantErr: true,
+		},
+		"invalid character": {
+			params:  &stripe.ChargeParams{StatementDescriptor: "TWG <SWAG>"},
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			requests = 0
+			c := stripe.Client{
+				Key:                 "gibberish-key",
+				BaseURL:             server.URL,
+				StatementDescriptor: tc.clientDefault,
+			}
+			charge, err := c.ChargeWithParams("cus_123", 1234, tc.params)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("err = nil; want an invalid statement descriptor error")
+				}
+				if requests != 0 {
+					t.Errorf("requests = %d; want 0 for an invalid descriptor", requests)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v; want nil", err)
+			}
+			if charge.StatementDescriptor != tc.want {
+				t.Errorf("StatementDescriptor = %q; want %q", charge.StatementDescriptor, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateStatementDescriptor(t *testing.T) {
+	tests := map[string]bool{
+		"TWG SWAG":                true,
+		"Gopher-Shirt 2":          true,
+		"TWG":                     false,
+		"12345678":                false,
+		"TEST WITH GO SWAG STORE": false,
+		`TWG "SWAG"`:              false,
+		"TWG SWAG*":               false,
+		"TWG SWÄG":                false,
+	}
+	for descriptor, valid := range tests {
+		err := stripe.ValidateStatementDescriptor(descriptor)
+		if valid && err != nil {
+			t.Errorf("ValidateStatementDescriptor(%q) err = %v; want nil", descriptor, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("ValidateStatementDescriptor(%q) err = nil; want non-nil", descriptor)
+		}
+	}
+}
+
+func TestClient_Observe(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/customers", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": "cus_123", "default_source": "card_123"}`)
+	})
+	mux.HandleFunc("/charges", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPaymentRequired)
+		fmt.Fprint(w, `{"error": {"code": "card_declined", "message": "Your card was declined.", "type": "card_error"}}`)
+	})
+	mux.HandleFunc("/charges/ch_proxy_error", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "<html><body><h1>502 Bad Gateway</h1></body></html>")
+	})
+	release := make(chan struct{})
+	mux.HandleFunc("/charges/ch_slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	defer close(release)
+
+	type observation struct {
+		op, outcome string
+	}
+	var got []observation
+	c := stripe.Client{
+		Key:         "gibberish-key",
+		BaseURL:     server.URL,
+		MaxAttempts: 1,
+		Observe: func(op, outcome string, d time.Duration) {
+			if d <= 0 {
+				t.Errorf("Observe(%s) duration = %v; want > 0", op, d)
+			}
+			got = append(got, observation{op, outcome})
+		},
+	}
+	if _, err := c.Customer("tok_amex", "test@testwithgo.com"); err != nil {
+		t.Fatalf("Customer() err = %v; want nil", err)
+	}
+	if _, err := c.Charge("cus_123", 1234); err == nil {
+		t.Fatalf("Charge() err = nil; want a card error")
+	}
+	if _, err := c.GetCharge("ch_proxy_error"); err == nil {
+		t.Fatalf("GetCharge() err = nil; want a decode error")
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.GetChargeContext(canceled, "ch_slow"); err == nil {
+		t.Fatalf("GetChargeContext() err = nil; want a canceled error")
+	}
+	expiring, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetChargeContext(expiring, "ch_slow"); err == nil {
+		t.Fatalf("GetChargeContext() err = nil; want a timeout error")
+	}
+	server.Close()
+	if _, err := c.Charge("cus_123", 1234); err == nil {
+		t.Fatalf("Charge() err = nil; want a network error")
+	}
+
+	want := []observation{
+		{"customer", "success"},
+		{"charge", stripe.ErrTypeCardError},
+		{"get_charge", "decode_error"},
+		{"get_charge", "canceled"},
+		{"get_charge", "timeout"},
+		{"charge", "network_error"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("observations = %v; want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("observations[%d] = %v; want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestClient_Void(t *testing.T) {
+	// fake Stripe that supports authorize-only charges, capture, and
+	// refunds with the charge expanded.
+	charges := make(map[string]*stripe.Charge)
+	var refunds []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/charges", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("ParseForm() err = %v; want nil", err)
+		}
+		amount, _ := strconv.Atoi(r.PostForm.Get("amount"))
+		chg := &stripe.Charge{
+			ID:       fmt.Sprintf("ch_%d", len(charges)+1),
+			Amount:   amount,
+			Captured: r.PostForm.Get("capture") != "false",
+			Paid:     true,
+			Status:   stripe.ChargeSucceeded,
+		}
+		charges[chg.ID] = chg
+		json.NewEncoder(w).Encode(chg)
+	})
+	mux.HandleFunc("/charges/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/charges/")
+		chg, ok := charges[strings.TrimSuffix(path, "/capture")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(errorJSON)
+			return
+		}
+		if strings.HasSuffix(path, "/capture") {
+			chg.Captured = true
+		}
+		json.NewEncoder(w).Encode(chg)
+	})
+	mux.HandleFunc("/refunds", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("ParseForm() err = %v; want nil", err)
+		}
+		id := r.PostForm.Get("charge")
+		refunds = append(refunds, id)
+		chg := charges[id]
+		chg.Refunded = true
+		chg.AmountRefunded = chg.Amount
+		if r.PostForm.Get("expand[]") != "charge" {
+			fmt.Fprintf(w, `{"id": "re_123", "charge": %q, "amount": %d, "status": "succeeded"}`, id, chg.Amount)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":     "re_123",
+			"charge": chg,
+			"amount": chg.Amount,
+			"status": "succeeded",
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var ops []string
+	c := stripe.Client{
+		Key:     "gibberish-key",
+		BaseURL: server.URL,
+		Observe: func(op, outcome string, d time.Duration) {
+			ops = append(ops, op+":"+outcome)
+		},
+	}
+	authorize := func(t *testing.T) *stripe.Charge {
+		capture := false
+		chg, err := c.ChargeWithParams("cus_123", 1234, &stripe.ChargeParams{Capture: &capture})
+		if err != nil {
+			t.Fatalf("ChargeWithParams() err = %v; want nil", err)
+		}
+		if chg.Captured {
+			t.Fatalf("Captured = true; want false for an authorize-only charge")
+		}
+		return chg
+	}
+
+	t.Run("authorize then void", func(t *testing.T) {
+		refunds, ops = nil, nil
+		chg := authorize(t)
+		chg, err := c.Void(chg.ID)
+		if err != nil {
+			t.Fatalf("Void() err = %v; want nil", err)
+		}
+		if !chg.Refunded {
+			t.Errorf("Refunded = false; want true")
+		}
+		if chg.Captured {
+			t.Errorf("Captured = true; want false")
+		}
+		if len(refunds) != 1 || refunds[0] != chg.ID {
+			t.Errorf("refunds = %v; want [%s]", refunds, chg.ID)
+		}
+		wantOps := []string{"charge:success", "void:success"}
+		if strings.Join(ops, ",") != strings.Join(wantOps, ",") {
+			t.Errorf("observed ops = %v; want %v", ops, wantOps)
+		}
+	})
+	t.Run("authorize, capture, then void", func(t *testing.T) {
+		refunds, ops = nil, nil
+		chg := authorize(t)
+		chg, err := c.Capture(chg.ID)
+		if err != nil {
+			t.Fatalf("Capture() err = %v; want nil", err)
+		}
+		if !chg.Captured {
+			t.Errorf("Captured = false; want true")
+		}
+		_, err = c.Void(chg.ID)
+		if err != stripe.ErrAlreadyCaptured {
+			t.Fatalf("Void() err = %v; want %v", err, stripe.ErrAlreadyCaptured)
+		}
+		if len(refunds) != 0 {
+			t.Errorf("refunds = %v; want none", refunds)
+		}
+		wantOps := []string{"charge:success", "capture:success", "void:already_captured"}
+		if strings.Join(ops, ",") != strings.Join(wantOps, ",") {
+			t.Errorf("observed ops = %v; want %v", ops, wantOps)
+		}
+	})
+	t.Run("captured immediately", func(t *testing.T) {
+		refunds = nil
+		chg, err := c.Charge("cus_123", 1234)
+		if err != nil {
+			t.Fatalf("Charge() err = %v; want nil", err)
+		}
+		_, err = c.Void(chg.ID)
+		if err != stripe.ErrAlreadyCaptured {
+			t.Fatalf("Void() err = %v; want %v", err, stripe.ErrAlreadyCaptured)
+		}
+		if len(refunds) != 0 {
+			t.Errorf("refunds = %v; want none", refunds)
+		}
+	})
+	t.Run("missing charge", func(t *testing.T) {
+		_, err := c.Void("ch_missing")
+		if _, ok := err.(stripe.Error); !ok {
+			t.Fatalf("err = %v; want a stripe.Error", err)
+		}
+	})
+}
+
+func TestClient_contextCancelled(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		// Block until the client gives up on the request or the test ends.
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	defer close(release)
+	c := stripe.Client{
+		Key:     "gibberish-key",
+		BaseURL: server.URL,
+	}
+
+	tests := map[string]func(ctx context.Context) error{
+		"CustomerContext": func(ctx context.Context) error {
+			_, err := c.CustomerContext(ctx, "tok_amex", "test@testwithgo.com")
+			return err
+		},
+		"ChargeContext": func(ctx context.Context) error {
+			_, err := c.ChargeContext(ctx, "cus_123", 1234, nil)
+			return err
+		},
+		"GetChargeContext": func(ctx context.Context) error {
+			_, err := c.GetChargeContext(ctx, "ch_123")
+			return err
+		},
+	}
+	for name, call := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(10*time.Millisecond, cancel)
+			errc := make(chan error, 1)
+			go func() { errc <- call(ctx) }()
+			select {
+			case err := <-errc:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("err = %v; want an error wrapping %v", err, context.Canceled)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("call did not return after the context was cancelled")
+			}
+		})
+	}
+
+	t.Run("between retries", func(t *testing.T) {
+		defer func(d time.Duration) { *stripe.RetryBaseDelay = d }(*stripe.RetryBaseDelay)
+		*stripe.RetryBaseDelay = time.Minute
+
+		hits := make(chan struct{}, 10)
+		flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits <- struct{}{}
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer flaky.Close()
+		c := stripe.Client{
+			Key:     "gibberish-key",
+			BaseURL: flaky.URL,
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := c.GetChargeContext(ctx, "ch_123")
+			errc <- err
+		}()
+		select {
+		case err := <-errc:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("err = %v; want an error wrapping %v", err, context.Canceled)
+			}
+			if err != nil && !strings.Contains(err.Error(), "GET /charges/ch_123") {
+				t.Errorf("err = %q; want it to name the request", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("call did not return after the context was cancelled")
+		}
+		if len(hits) != 1 {
+			t.Errorf("requests = %d; want 1", len(hits))
+		}
+	})
+}
+
+func TestClient_ChargeWithParams_idempotencyKey(t *testing.T) {
+	var created int
+	byKey := make(map[string]string)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/charges", func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		id, ok := byKey[key]
+		if !ok || key == "" {
+			created++
+			id = fmt.Sprintf("ch_%d", created)
+			byKey[key] = id
+		}
+		fmt.Fprintf(w, `{"id": %q, "amount": 1234, "status": "succeeded"}`, id)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	c := stripe.Client{
+		Key:     "gibberish-key",
+		BaseURL: server.URL,
+	}
+
+	t.Run("same key", func(t *testing.T) {
+		created = 0
+		params := &stripe.ChargeParams{IdempotencyKey: "order-12-same"}
+		first, err := c.ChargeWithParams("cus_123", 1234, params)
+		if err != nil {
+			t.Fatalf("first charge err = %v; want nil", err)
+		}
+		second, err := c.ChargeWithParams("cus_123", 1234, params)
+		if err != nil {
+			t.Fatalf("second charge err = %v; want nil", err)
+		}
+		if first.ID != second.ID {
+			t.Errorf("charge IDs = %s, %s; want the same charge", first.ID, second.ID)
+		}
+		if created != 1 {
+			t.Errorf("charges created = %d; want 1", created)
+		}
+	})
+	t.Run("no key", func(t *testing.T) {
+		created = 0
+		for i := 0; i < 2; i++ {
+			if _, err := c.Charge("cus_123", 1234); err != nil {
+				t.Fatalf("Charge() err = %v; want nil", err)
+			}
+		}
+		if created != 2 {
+			t.Errorf("charges created = %d; want 2", created)
+		}
+	})
+}
+
+func TestClient_Refund(t *testing.T) {
+	refunded := map[string]bool{"ch_refunded": true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/refunds", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("ParseForm() err = %v; want nil", err)
+		}
+		id := r.PostForm.Get("charge")
+		switch {
+		case id == "ch_missing":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"error": {"code": "resource_missing", "message": "No such charge: %s", "param": "charge", "type": "invalid_request_error"}}`, id)
+		case refunded[id]:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": {"code": "charge_already_refunded", "message": "Charge %s has already been refunded.", "type": "invalid_request_error"}}`, id)
+		default:
+			refunded[id] = true
+			amount := r.PostForm.Get("amount")
+			if amount == "" {
+				amount = "1234"
+			}
+			fmt.Fprintf(w, `{"id": "re_123", "object": "refund", "amount": %s, "charge": %q, "status": "succeeded"}`, amount, id)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	c := stripe.Client{
+		Key:     "gibberish-key",
+		BaseURL: server.URL,
+	}
+
+	t.Run("success", func(t *testing.T) {
+		re, err := c.Refund("ch_123")
+		if err != nil {
+			t.Fatalf("Refund() err = %v; want nil", err)
+		}
+		if re.ChargeID != "ch_123" {
+			t.Errorf("ChargeID = %s; want %s", re.ChargeID, "ch_123")
+		}
+		if re.Amount != 1234 {
+			t.Errorf("Amount = %d; want %d", re.Amount, 1234)
+		}
+		if re.Status != "succeeded" {
+			t.Errorf("Status = %s; want %s", re.Status, "succeeded")
+		}
+	})
+	t.Run("partial", func(t *testing.T) {
+		re, err := c.RefundWithParams("ch_456", &stripe.RefundParams{Amount: 500})
+		if err != nil {
+			t.Fatalf("RefundWithParams() err = %v; want nil", err)
+		}
+		if re.Amount != 500 {
+			t.Errorf("Amount = %d; want %d", re.Amount, 500)
+		}
+	})
+	t.Run("negative amount", func(t *testing.T) {
+		_, err := c.RefundWithParams("ch_789", &stripe.RefundParams{Amount: -1})
+		if err == nil {
+			t.Fatalf("RefundWithParams() err = nil; want an error")
+		}
+		if refunded["ch_789"] {
+			t.Errorf("charge was refunded; want the request rejected before reaching Stripe")
+		}
+	})
+	for name, tc := range map[string]struct {
+		chargeID string
+		code     string
+	}{
+		"already refunded": {"ch_refunded", stripe.ErrCodeChargeAlreadyRefunded},
+		"charge not found": {"ch_missing", stripe.ErrCodeResourceMissing},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := c.Refund(tc.chargeID)
+			se, ok := err.(stripe.Error)
+			if !ok {
+				t.Fatalf("err = %v; want a stripe.Error", err)
+			}
+			if se.Code != tc.code {
+				t.Errorf("err.Code = %s; want %s", se.Code, tc.code)
+			}
+		})
+	}
+}
+
+func TestDefaultHTTPClient(t *testing.T) {
+	if got := stripe.DefaultHTTPClient().Timeout; got != stripe.DefaultTimeout {
+		t.Errorf("Timeout = %v; want %v", got, stripe.DefaultTimeout)
+	}
+}
+
+func TestClient_HttpClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	defer close(release)
+	c := stripe.Client{
+		Key:        "gibberish-key",
+		BaseURL:    server.URL,
+		HttpClient: &http.Client{Timeout: 50 * time.Millisecond},
+	}
+
+	start := time.Now()
+	_, err := c.Charge("cus_123", 1234)
+	if err == nil {
+		t.Fatalf("err = nil; want a timeout error")
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("err = %v; want a timeout error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Charge() took %v; want it to give up after the client timeout", elapsed)
+	}
+}
+
+func TestClient_retries(t *testing.T) {
+	defer func(d time.Duration) { *stripe.RetryBaseDelay = d }(*stripe.RetryBaseDelay)
+	*stripe.RetryBaseDelay = time.Millisecond
+
+	// flakyServer fails the first failures requests with a 500, then
+	// succeeds. If shouldRetry is set it is sent as Stripe-Should-Retry on
+	// the failures. It reports how many requests it received.
+	flakyServer := func(failures int, shouldRetry string) (*httptest.Server, *int) {
+		var requests int
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests <= failures {
+				if shouldRetry != "" {
+					w.Header().Set("Stripe-Should-Retry", shouldRetry)
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, `{"error": {"message": "An unknown error occurred", "type": "api_error"}}`)
+				return
+			}
+			fmt.Fprint(w, `{"id": "ch_123", "amount": 1234, "status": "succeeded"}`)
+		}
+		return httptest.NewServer(http.HandlerFunc(handler)), &requests
+	}
+
+	tests := map[string]struct {
+		failures     int
+		shouldRetry  string
+		maxAttempts  int
+		call         func(c *stripe.Client) (*stripe.Charge, error)
+		wantRequests int
+		wantErr      bool
+	}{
+		"get succeeds after two failures": {
+			failures:     2,
+			call:         func(c *stripe.Client) (*stripe.Charge, error) { return c.GetCharge("ch_123") },
+			wantRequests: 3,
+		},
+		"charge with idempotency key succeeds after two failures": {
+			failures: 2,
+			call: func(c *stripe.Client) (*stripe.Charge, error) {
+				return c.ChargeWithParams("cus_123", 1234, &stripe.ChargeParams{IdempotencyKey: "order-12"})
+			},
+			wantRequests: 3,
+		},
+		"charge without idempotency key is not retried": {
+			failures:     2,
+			call:         func(c *stripe.Client) (*stripe.Charge, error) { return c.Charge("cus_123", 1234) },
+			wantRequests: 1,
+			wantErr:      true,
+		},
+		"charge with idempotency key stops when Stripe says not to retry": {
+			failures:    2,
+			shouldRetry: "false",
+			call: func(c *stripe.Client) (*stripe.Charge, error) {
+				return c.ChargeWithParams("cus_123", 1234, &stripe.ChargeParams{IdempotencyKey: "order-12"})
+			},
+			wantRequests: 1,
+			wantErr:      true,
+		},
+		"gives up after max attempts": {
+			failures:     5,
+			maxAttempts:  2,
+			call:         func(c *stripe.Client) (*stripe.Charge, error) { return c.GetCharge("ch_123") },
+			wantRequests: 2,
+			wantErr:      true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, requests := flakyServer(tc.failures, tc.shouldRetry)
+			defer server.Close()
+			c := &stripe.Client{
+				Key:         "gibberish-key",
+				BaseURL:     server.URL,
+				MaxAttempts: tc.maxAttempts,
+			}
+			charge, err := tc.call(c)
+			if *requests != tc.wantRequests {
+				t.Errorf("requests = %d; want %d", *requests, tc.wantRequests)
+			}
+			if tc.wantErr {
+				se, ok := err.(stripe.Error)
+				if !ok || se.Type != stripe.ErrTypeAPIError {
+					t.Errorf("err = %v; want a stripe.Error of type %s", err, stripe.ErrTypeAPIError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v; want nil", err)
+			}
+			if charge.ID != "ch_123" {
+				t.Errorf("ID = %s; want %s", charge.ID, "ch_123")
+			}
+		})
+	}
+}
+
+// countingClient counts requests before passing them to do.
+type countingClient struct {
+	calls int
+	do    func(*http.Request) (*http.Response, error)
+}
+
+func (cc *countingClient) Do(req *http.Request) (*http.Response, error) {
+	cc.calls++
+	return cc.do(req)
+}
+
+func TestClient_retriesTransportErrorsOnly(t *testing.T) {
+	defer func(d time.Duration) { *stripe.RetryBaseDelay = d }(*stripe.RetryBaseDelay)
+	*stripe.RetryBaseDelay = time.Millisecond
+
+	tests := map[string]struct {
+		baseURL   string
+		do        func(*http.Request) (*http.Response, error)
+		wantCalls int
+	}{
+		"connection refused": {
+			baseURL: "http://stripe.invalid",
+			do: func(req *http.Request) (*http.Response, error) {
+				return nil, &url.Error{Op: "Get", URL: req.URL.String(), Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+			},
+			wantCalls: stripe.DefaultMaxAttempts,
+		},
+		"connection dropped": {
+			baseURL: "http://stripe.invalid",
+			do: func(req *http.Request) (*http.Response, error) {
+				return nil, &url.Error{Op: "Get", URL: req.URL.String(), Err: io.EOF}
+			},
+			wantCalls: stripe.DefaultMaxAttempts,
+		},
+		"unsupported scheme": {
+			baseURL:   "ftp://stripe.invalid",
+			do:        (&http.Client{}).Do,
+			wantCalls: 1,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cc := &countingClient{do: tc.do}
+			c := stripe.Client{
+				Key:        "gibberish-key",
+				BaseURL:    tc.baseURL,
+				HttpClient: cc,
+			}
+			_, err := c.GetCharge("ch_123")
+			if err == nil {
+				t.Fatalf("GetCharge() err = nil; want non-nil")
+			}
+			if cc.calls != tc.wantCalls {
+				t.Errorf("calls = %d; want %d", cc.calls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base := *stripe.RetryBaseDelay
+	for attempt := 1; attempt <= 4; attempt++ {
+		max := base << uint(attempt-1)
+		for i := 0; i < 50; i++ {
+			got := stripe.Backoff(attempt)
+			if got < max/2 || got > max {
+				t.Fatalf("Backoff(%d) = %v; want between %v and %v", attempt, got, max/2, max)
+			}
+		}
+	}
+}
+
+func TestClient_ChargeWithParams_currency(t *testing.T) {
+	var requests int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/charges", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("ParseForm() err = %v; want nil", err)
+		}
+		fmt.Fprintf(w, `{"id": "ch_123", "amount": 1234, "currency": %q, "status": "succeeded"}`, r.PostForm.Get("currency"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	c := stripe.Client{
+		Key:     "gibberish-key",
+		BaseURL: server.URL,
+	}
+
+	tests := map[string]struct {
+		currency string
+		want     string
+		wantErr  bool
+	}{
+		"default":   {currency: "", want: "usd"},
+		"usd":       {currency: "usd", want: "usd"},
+		"eur":       {currency: "eur", want: "eur"},
+		"uppercase": {currency: "GBP", want: "gbp"},
+		"invalid":   {currency: "XYZ", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			requests = 0
+			charge, err := c.ChargeWithParams("cus_123", 1234, &stripe.ChargeParams{Currency: tc.currency})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("err = nil; want an unsupported currency error")
+				}
+				if !strings.Contains(err.Error(), `"xyz"`) {
+					t.Errorf("err = %v; want it to name the currency %q", err, "xyz")
+				}
+				if requests != 0 {
+					t.Errorf("requests = %d; want 0 for an unsupported currency", requests)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v; want nil", err)
+			}
+			if charge.Currency != tc.want {
+				t.Errorf("Currency = %s; want %s", charge.Currency, tc.want)
+			}
+		})
+	}
+}
+
+func TestClient_Charge_minimumChargesOverridden(t *testing.T) {
+	orig := stripe.MinimumCharges
+	defer func() { stripe.MinimumCharges = orig }()
+	stripe.MinimumCharges = map[string]int{"eur": 50}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": "ch_123", "amount": 1234, "currency": "usd", "status": "succeeded"}`)
+	}))
+	defer server.Close()
+	c := stripe.Client{
+		Key:     "gibberish-key",
+		BaseURL: server.URL,
+	}
+	if _, err := c.Charge("cus_123", 1234); err != nil {
+		t.Fatalf("Charge() err = %v; want nil even without usd in MinimumCharges", err)
+	}
+
+	stripe.MinimumCharges["xts"] = 10
+	if _, err := c.ChargeWithParams("cus_123", 1234, &stripe.ChargeParams{Currency: "xts"}); err == nil {
+		t.Errorf("ChargeWithParams(xts) err = nil; want an error, MinimumCharges doesn't add currencies")
+	}
+}
+
+func TestClient_ChargeWithParams_metadata(t *testing.T) {
+	var stored map[string]string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/charges", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("ParseForm() err = %v; want nil", err)
+		}
+		stored = make(map[string]string)
+		for key := range r.PostForm {
+			if strings.HasPrefix(key, "metadata[") && strings.HasSuffix(key, "]") {
+				stored[key[len("metadata["):len(key)-1]] = r.PostForm.Get(key)
+			}
+		}
+		fmt.Fprint(w, `{"id": "ch_123", "amount": 1234, "status": "succeeded"}`)
+	})
+	mux.HandleFunc("/charges/ch_123", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":       "ch_123",
+			"amount":   1234,
+			"status":   "succeeded",
+			"metadata": stored,
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	c := stripe.Client{
+		Key:     "gibberish-key",
+		BaseURL: server.URL,
+	}
+
+	want := map[string]string{
+		"order_id":    "12",
+		"campaign_id": "5",
+	}
+	_, err := c.ChargeWithParams("cus_123", 1234, &stripe.ChargeParams{Metadata: want})
+	if err != nil {
+		t.Fatalf("ChargeWithParams() err = %v; want nil", err)
+	}
+	charge, err := c.GetCharge("ch_123")
+	if err != nil {
+		t.Fatalf("GetCharge() err = %v; want nil", err)
+	}
+	if len(charge.Metadata) != len(want) {
+		t.Errorf("Metadata = %v; want %v", charge.Metadata, want)
+	}
+	for key, value := range want {
+		if got := charge.Metadata[key]; got != value {
+			t.Errorf("Metadata[%q] = %q; want %q", key, got, value)
+		}
+	}
+}
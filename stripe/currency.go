@@ -0,0 +1,47 @@
+package stripe
+
+import "strings"
+
+// currencies lists every currency ChargeWithParams accepts, with Stripe's
+// default minimum charge for each in that currency's smallest unit. It is
+// the only thing that decides what can be charged; MinimumCharges starts
+// as a copy of it.
+var currencies = map[string]int{
+	"aud": 50,
+	"cad": 50,
+	"chf": 50,
+	"dkk": 250,
+	"eur": 50,
+	"gbp": 30,
+	"hkd": 400,
+	"jpy": 50,
+	"mxn": 1000,
+	"nok": 300,
+	"nzd": 50,
+	"sek": 300,
+	"sgd": 50,
+	"usd": 50,
+}
+
+// MinimumCharges maps a lowercase currency code to the smallest amount, in
+// that currency's smallest unit, that Stripe will charge. It starts with
+// Stripe's defaults for every supported currency. Override entries to match
+// your account, but only during startup: the map is read without locking,
+// so it must not change once MinimumCharge may be called concurrently.
+//
+// MinimumCharges only affects what MinimumCharge reports. Adding or removing
+// a currency here doesn't change which currencies ChargeWithParams accepts.
+var MinimumCharges = defaultMinimumCharges()
+
+func defaultMinimumCharges() map[string]int {
+	m := make(map[string]int, len(currencies))
+	for code, min := range currencies {
+		m[code] = min
+	}
+	return m
+}
+
+func MinimumCharge(currency string) (int, bool) {
+	min, ok := MinimumCharges[strings.ToLower(currency)]
+	return min, ok
+}
@@ -0,0 +1,50 @@
+package stripe_test
+
+import (
+	"testing"
+
+	"github.com/joncalhoun/twg/stripe"
+)
+
+func TestMinimumCharge(t *testing.T) {
+	tests := map[string]struct {
+		currency string
+		want     int
+		wantOk   bool
+	}{
+		"usd":          {"usd", 50, true},
+		"uppercase":    {"USD", 50, true},
+		"gbp":          {"gbp", 30, true},
+		"zero decimal": {"jpy", 50, true},
+		"unknown":      {"xyz", 0, false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok := stripe.MinimumCharge(tc.currency)
+			if ok != tc.wantOk {
+				t.Fatalf("MinimumCharge(%q) ok = %t; want %t", tc.currency, ok, tc.wantOk)
+			}
+			if got != tc.want {
+				t.Errorf("MinimumCharge(%q) = %d; want %d", tc.currency, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMinimumCharge_override(t *testing.T) {
+	orig, ok := stripe.MinimumCharges["usd"]
+	defer func() {
+		if ok {
+			stripe.MinimumCharges["usd"] = orig
+		}
+		delete(stripe.MinimumCharges, "xts")
+	}()
+	stripe.MinimumCharges["usd"] = 100
+	stripe.MinimumCharges["xts"] = 7
+	if got, _ := stripe.MinimumCharge("usd"); got != 100 {
+		t.Errorf("MinimumCharge(usd) = %d; want %d", got, 100)
+	}
+	if got, ok := stripe.MinimumCharge("xts"); !ok || got != 7 {
+		t.Errorf("MinimumCharge(xts) = %d, %t; want %d, true", got, ok, 7)
+	}
+}
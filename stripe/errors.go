@@ -1,21 +1,74 @@
 package stripe
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 )
 
 const (
+	ErrTypeAPIError       = "api_error"
 	ErrTypeCardError      = "card_error"
 	ErrTypeInvalidRequest = "invalid_request_error"
+	ErrTypeRateLimit      = "rate_limit_error"
 )
 
+const (
+	ErrCodeCardDeclined          = "card_declined"
+	ErrCodeChargeAlreadyRefunded = "charge_already_refunded"
+	ErrCodeResourceMissing       = "resource_missing"
+)
+
+// ErrAlreadyCaptured is returned by Void when the charge has already been
+// captured and must be refunded instead.
+var ErrAlreadyCaptured = errors.New("stripe: charge has already been captured")
+
+// Outcome classifies the result of an API call for metrics:
+//
+//   - "success" for a nil error
+//   - the Stripe error type (e.g. "card_error") for an Error
+//   - "already_captured" for ErrAlreadyCaptured
+//   - "canceled" when the caller's context was cancelled
+//   - "timeout" when the context deadline or HTTP client timeout passed
+//   - "decode_error" when the response wasn't the JSON Stripe sends, such
+//     as an HTML error page from a proxy
+//   - "network_error" for anything else
+func Outcome(err error) string {
+	if err == nil {
+		return "success"
+	}
+	if se, ok := err.(Error); ok && se.Type != "" {
+		return se.Type
+	}
+	if errors.Is(err, ErrAlreadyCaptured) {
+		return "already_captured"
+	}
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return "timeout"
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return "decode_error"
+	}
+	return "network_error"
+}
+
 type Error struct {
-	Code    string `json:"code"`
-	DocURL  string `json:"doc_url"`
-	Message string `json:"message"`
-	Param   string `json:"param"`
-	Type    string `json:"type"`
+	Code string `json:"code"`
+	// DeclineCode is set on card errors when the issuer gives a reason,
+	// e.g. "insufficient_funds".
+	DeclineCode string `json:"decline_code"`
+	DocURL      string `json:"doc_url"`
+	Message     string `json:"message"`
+	Param       string `json:"param"`
+	Type        string `json:"type"`
 }
 
 func (err Error) Error() string {
@@ -25,11 +78,12 @@ func (err Error) Error() string {
 func (err Error) MarshalJSON() ([]byte, error) {
 	var tmp struct {
 		Error struct {
-			Code    string `json:"code"`
-			DocURL  string `json:"doc_url"`
-			Message string `json:"message"`
-			Param   string `json:"param"`
-			Type    string `json:"type"`
+			Code        string `json:"code"`
+			DeclineCode string `json:"decline_code"`
+			DocURL      string `json:"doc_url"`
+			Message     string `json:"message"`
+			Param       string `json:"param"`
+			Type        string `json:"type"`
 		} `json:"error"`
 	}
 	tmp.Error = err
@@ -39,11 +93,12 @@ func (err Error) MarshalJSON() ([]byte, error) {
 func (err *Error) UnmarshalJSON(data []byte) error {
 	var tmp struct {
 		Error struct {
-			Code    string `json:"code"`
-			DocURL  string `json:"doc_url"`
-			Message string `json:"message"`
-			Param   string `json:"param"`
-			Type    string `json:"type"`
+			Code        string `json:"code"`
+			DeclineCode string `json:"decline_code"`
+			DocURL      string `json:"doc_url"`
+			Message     string `json:"message"`
+			Param       string `json:"param"`
+			Type        string `json:"type"`
 		} `json:"error"`
 	}
 	if err := json.Unmarshal(data, &tmp); err != nil {
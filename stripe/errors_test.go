@@ -39,11 +39,12 @@ func TestError_Unmarshal(t *testing.T) {
 
 func TestError_Marshal(t *testing.T) {
 	se := stripe.Error{
-		Code:    "test-code",
-		DocURL:  "test-docUrl",
-		Message: "test-message",
-		Param:   "test-param",
-		Type:    "test-type",
+		Code:        "test-code",
+		DeclineCode: "test-decline-code",
+		DocURL:      "test-docUrl",
+		Message:     "test-message",
+		Param:       "test-param",
+		Type:        "test-type",
 	}
 	data, err := json.Marshal(se)
 	if err != nil {
@@ -59,3 +60,47 @@ func TestError_Marshal(t *testing.T) {
 		t.Log("Is Unmarshal working? It is required for this test to pass.")
 	}
 }
+
+func TestError_Unmarshal_fields(t *testing.T) {
+	tests := map[string]struct {
+		body string
+		want stripe.Error
+	}{
+		"card declined": {
+			body: `{"error": {"code": "card_declined", "decline_code": "insufficient_funds", "message": "Your card has insufficient funds.", "type": "card_error"}}`,
+			want: stripe.Error{
+				Code:        stripe.ErrCodeCardDeclined,
+				DeclineCode: "insufficient_funds",
+				Message:     "Your card has insufficient funds.",
+				Type:        stripe.ErrTypeCardError,
+			},
+		},
+		"rate limit": {
+			body: `{"error": {"code": "rate_limit", "message": "Too many requests hit the API too quickly.", "type": "rate_limit_error"}}`,
+			want: stripe.Error{
+				Code:    "rate_limit",
+				Message: "Too many requests hit the API too quickly.",
+				Type:    stripe.ErrTypeRateLimit,
+			},
+		},
+		"api error": {
+			body: `{"error": {"message": "An unknown error occurred", "type": "api_error"}}`,
+			want: stripe.Error{
+				Message: "An unknown error occurred",
+				Type:    stripe.ErrTypeAPIError,
+			},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got stripe.Error
+			err := json.Unmarshal([]byte(tc.body), &got)
+			if err != nil {
+				t.Fatalf("Unmarshal() err = %v; want nil", err)
+			}
+			if got != tc.want {
+				t.Errorf("got = %+v; want %+v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+package stripe
+
+var Backoff = backoff
+
+var DefaultHTTPClient = defaultHTTPClient
+
+var RetryBaseDelay = &retryBaseDelay